@@ -0,0 +1,154 @@
+package starter
+
+import (
+	"fmt"
+	"net"
+	"net/rpc"
+	"os"
+	"time"
+)
+
+// ControlStatus is the reply to the Status RPC: the supervisor's
+// current generation and every worker (current and old) it is
+// tracking.
+type ControlStatus struct {
+	Generation int
+	Workers    []ControlWorker
+}
+
+// ControlWorker describes a single worker process as seen by the
+// control API.
+type ControlWorker struct {
+	Pid        int
+	Generation int
+	Old        bool // true if this is an old worker being drained, not the current one
+}
+
+type StatusArgs struct{}
+
+type ReloadArgs struct{}
+type ReloadReply struct{}
+
+type RestartArgs struct{}
+type RestartReply struct{}
+
+// SignalArgs names a signal to deliver to the current worker, e.g.
+// "TERM". Resolved the same way as SigFromName.
+type SignalArgs struct {
+	Name string
+}
+type SignalReply struct{}
+
+// ShutdownArgs optionally overrides the supervisor's configured
+// GracefulShutdownTimeout for this one shutdown. Zero keeps the
+// configured value.
+type ShutdownArgs struct {
+	TimeoutSeconds int64
+}
+type ShutdownReply struct{}
+
+type controlOp int
+
+const (
+	controlStatus controlOp = iota
+	controlReload
+	controlRestart
+	controlSignal
+	controlShutdown
+)
+
+// controlRequest is handed from an RPC handler goroutine into Run()'s
+// main select loop, which is the only goroutine that may touch
+// Starter's worker state.
+type controlRequest struct {
+	op      controlOp
+	signal  os.Signal
+	timeout time.Duration
+	reply   chan controlReply
+}
+
+type controlReply struct {
+	status ControlStatus
+	err    error
+}
+
+// Control is the RPC service exposed over the supervisor's control
+// socket (see Config.ControlSocket). It gives operators a
+// programmable alternative to the signal-only interface: Status to
+// poll worker state, Reload/Restart to trigger a rolling restart
+// synchronously, Signal to deliver an arbitrary signal, and Shutdown
+// to stop the supervisor gracefully.
+type Control struct {
+	reqCh chan controlRequest
+}
+
+func (c *Control) do(req controlRequest) controlReply {
+	req.reply = make(chan controlReply, 1)
+	c.reqCh <- req
+	return <-req.reply
+}
+
+// Status reports the pid/generation of the current worker plus any
+// old workers still being drained. A Status request that arrives while
+// a rolling restart or a crash-loop backoff is in progress gets an
+// empty ControlStatus.
+func (c *Control) Status(args *StatusArgs, reply *ControlStatus) error {
+	*reply = c.do(controlRequest{op: controlStatus}).status
+	return nil
+}
+
+// Reload is the synchronous equivalent of sending SIGHUP: it returns
+// once the newly spawned worker has passed Config.Interval()'s
+// liveness check, rather than firing and forgetting.
+func (c *Control) Reload(args *ReloadArgs, reply *ReloadReply) error {
+	return c.do(controlRequest{op: controlReload}).err
+}
+
+// Restart forces a new worker to be spawned even if the current one
+// is healthy.
+func (c *Control) Restart(args *RestartArgs, reply *RestartReply) error {
+	return c.do(controlRequest{op: controlRestart}).err
+}
+
+// Signal delivers an arbitrary signal, looked up via SigFromName, to
+// the current worker.
+func (c *Control) Signal(args *SignalArgs, reply *SignalReply) error {
+	sig := SigFromName(args.Name)
+	if sig == nil {
+		return fmt.Errorf("control: unknown signal %q", args.Name)
+	}
+	c.do(controlRequest{op: controlSignal, signal: sig})
+	return nil
+}
+
+// Shutdown gracefully stops the supervisor, optionally overriding its
+// configured GracefulShutdownTimeout for this one call. The override
+// is applied only when the request is handled by Run()'s main loop; a
+// Shutdown that arrives during a rolling restart or a crash-loop
+// backoff uses the configured timeout.
+func (c *Control) Shutdown(args *ShutdownArgs, reply *ShutdownReply) error {
+	c.do(controlRequest{op: controlShutdown, timeout: time.Duration(args.TimeoutSeconds) * time.Second})
+	return nil
+}
+
+// serveControl removes any stale socket left over from a previous
+// run, listens on socketPath, and serves RPC requests against reqCh
+// in the background until the returned listener is closed.
+func serveControl(socketPath string, reqCh chan controlRequest) (net.Listener, error) {
+	os.Remove(socketPath)
+
+	l, err := net.Listen("unix", socketPath)
+	if err != nil {
+		return nil, err
+	}
+
+	server := rpc.NewServer()
+	if err := server.RegisterName("Control", &Control{reqCh: reqCh}); err != nil {
+		l.Close()
+		return nil, err
+	}
+
+	go server.Accept(l)
+
+	return l, nil
+}
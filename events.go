@@ -0,0 +1,99 @@
+package starter
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+// EventKind identifies the kind of supervisor lifecycle event
+// reported on Starter.Events().
+type EventKind int
+
+const (
+	WorkerSpawned EventKind = iota
+	WorkerDied
+	SignalReceived
+	ReloadBegin
+	ReloadComplete
+	OldWorkerKilled
+)
+
+func (k EventKind) String() string {
+	switch k {
+	case WorkerSpawned:
+		return "WorkerSpawned"
+	case WorkerDied:
+		return "WorkerDied"
+	case SignalReceived:
+		return "SignalReceived"
+	case ReloadBegin:
+		return "ReloadBegin"
+	case ReloadComplete:
+		return "ReloadComplete"
+	case OldWorkerKilled:
+		return "OldWorkerKilled"
+	default:
+		return "Unknown"
+	}
+}
+
+// Event is a single supervisor lifecycle event, delivered on
+// Starter.Events() and (unless disabled) mirrored to stderr.
+type Event struct {
+	Kind       EventKind
+	Pid        int
+	Generation int
+	ExitStatus int
+	Signal     string
+	Promoted   bool // ReloadComplete: whether the new worker passed its health check
+	FailedPid  int  // ReloadComplete: pid of the replacement that failed its health check, when !Promoted
+	Time       time.Time
+}
+
+func (ev Event) String() string {
+	switch ev.Kind {
+	case WorkerSpawned:
+		return fmt.Sprintf("worker %d started (generation %d)", ev.Pid, ev.Generation)
+	case WorkerDied:
+		return fmt.Sprintf("worker %d died, status:%d", ev.Pid, ev.ExitStatus)
+	case SignalReceived:
+		return fmt.Sprintf("received %s", ev.Signal)
+	case ReloadBegin:
+		return fmt.Sprintf("reload: spawning a new worker to replace %d", ev.Pid)
+	case ReloadComplete:
+		if ev.Promoted {
+			return fmt.Sprintf("reload: worker %d promoted (generation %d)", ev.Pid, ev.Generation)
+		}
+		return fmt.Sprintf("reload: worker %d failed its health check, rolled back to %d", ev.FailedPid, ev.Pid)
+	case OldWorkerKilled:
+		return fmt.Sprintf("old worker %d killed, status:%d", ev.Pid, ev.ExitStatus)
+	default:
+		return fmt.Sprintf("unknown event kind %d", ev.Kind)
+	}
+}
+
+// Events returns a channel of supervisor lifecycle events. The
+// channel is buffered; a consumer that falls behind misses events
+// rather than blocking the supervisor.
+func (s *Starter) Events() <-chan Event {
+	return s.events
+}
+
+// emit stamps ev with the current time, delivers it on s.Events(),
+// updates the /metrics counters and gauges, and (unless
+// Config.DisableStderrLogging() is set) prints it to stderr.
+func (s *Starter) emit(ev Event) {
+	ev.Time = time.Now()
+
+	select {
+	case s.events <- ev:
+	default:
+	}
+
+	s.recordMetric(ev)
+
+	if !s.disableStderrLogging {
+		fmt.Fprintf(os.Stderr, "%s\n", ev)
+	}
+}
@@ -0,0 +1,81 @@
+// Package listener provides helpers for processes that are started
+// by a Starter to recover the listening sockets (TCP ports as well
+// as UNIX domain sockets) that were bound by the parent and passed
+// down via SERVER_STARTER_PORT / ExtraFiles.
+package listener
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Ports returns the raw "address=fd" (or "path=fd" for UNIX domain
+// sockets) entries found in SERVER_STARTER_PORT, in the order the
+// parent bound them.
+func Ports() ([]string, error) {
+	v := os.Getenv("SERVER_STARTER_PORT")
+	if v == "" {
+		return nil, fmt.Errorf("listener: SERVER_STARTER_PORT not set")
+	}
+
+	return strings.Split(v, ";"), nil
+}
+
+// Fds returns the file descriptors passed down by the parent
+// process, in the same order as Ports().
+func Fds() ([]uintptr, error) {
+	ports, err := Ports()
+	if err != nil {
+		return nil, err
+	}
+
+	fds := make([]uintptr, len(ports))
+	for i, port := range ports {
+		pair := strings.SplitN(port, "=", 2)
+		if len(pair) != 2 {
+			return nil, fmt.Errorf("listener: could not parse SERVER_STARTER_PORT entry %q", port)
+		}
+
+		fd, err := strconv.ParseUint(pair[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("listener: could not parse fd in SERVER_STARTER_PORT entry %q: %s", port, err)
+		}
+		fds[i] = uintptr(fd)
+	}
+
+	return fds, nil
+}
+
+// ListenAll creates a net.Listener for every file descriptor passed
+// down via SERVER_STARTER_PORT, in order. TCP ports and UNIX domain
+// sockets are both supported: net.FileListener inspects the
+// underlying socket and hands back the correct concrete type
+// (*net.TCPListener or *net.UnixListener) on its own, so callers
+// that need to tell them apart can still do so by looking at the
+// left-hand side of the corresponding Ports() entry.
+func ListenAll() ([]net.Listener, error) {
+	ports, err := Ports()
+	if err != nil {
+		return nil, err
+	}
+
+	fds, err := Fds()
+	if err != nil {
+		return nil, err
+	}
+
+	listeners := make([]net.Listener, len(fds))
+	for i, fd := range fds {
+		f := os.NewFile(fd, ports[i])
+		l, err := net.FileListener(f)
+		if err != nil {
+			return nil, fmt.Errorf("listener: failed to create listener from fd %d (%s): %s", fd, ports[i], err)
+		}
+		listeners[i] = l
+	}
+
+	return listeners, nil
+}
@@ -0,0 +1,95 @@
+package starter
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+)
+
+// starterMetrics accumulates the counters and gauges exposed on
+// /metrics from the events Run() emits.
+type starterMetrics struct {
+	mu                 sync.Mutex
+	workerRestarts     int
+	exitStatusCounts   map[int]int
+	oldWorkers         int
+	reloadDurationSecs float64
+}
+
+func newStarterMetrics() *starterMetrics {
+	return &starterMetrics{exitStatusCounts: make(map[int]int)}
+}
+
+// recordMetric folds a single Event into the running /metrics
+// counters and gauges.
+func (s *Starter) recordMetric(ev Event) {
+	m := s.metrics
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	switch ev.Kind {
+	case WorkerSpawned:
+		if ev.Generation > 1 {
+			m.workerRestarts++
+		}
+	case WorkerDied:
+		m.exitStatusCounts[ev.ExitStatus]++
+	case ReloadBegin:
+		m.oldWorkers++
+	case ReloadComplete:
+		m.reloadDurationSecs = ev.Time.Sub(s.reloadStartedAt).Seconds()
+	case OldWorkerKilled:
+		m.exitStatusCounts[ev.ExitStatus]++
+		if m.oldWorkers > 0 {
+			m.oldWorkers--
+		}
+	}
+}
+
+// ServeHTTP renders the current counters/gauges in the Prometheus
+// text exposition format.
+func (m *starterMetrics) ServeHTTP(w http.ResponseWriter, r *http.Request, generation int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP server_starter_worker_restarts_total Number of times a worker has been restarted.\n")
+	fmt.Fprintf(w, "# TYPE server_starter_worker_restarts_total counter\n")
+	fmt.Fprintf(w, "server_starter_worker_restarts_total %d\n", m.workerRestarts)
+
+	fmt.Fprintf(w, "# HELP server_starter_current_generation Generation number of the current worker.\n")
+	fmt.Fprintf(w, "# TYPE server_starter_current_generation gauge\n")
+	fmt.Fprintf(w, "server_starter_current_generation %d\n", generation)
+
+	fmt.Fprintf(w, "# HELP server_starter_old_workers Number of old workers still being drained.\n")
+	fmt.Fprintf(w, "# TYPE server_starter_old_workers gauge\n")
+	fmt.Fprintf(w, "server_starter_old_workers %d\n", m.oldWorkers)
+
+	fmt.Fprintf(w, "# HELP server_starter_reload_duration_seconds Duration of the most recent rolling restart.\n")
+	fmt.Fprintf(w, "# TYPE server_starter_reload_duration_seconds gauge\n")
+	fmt.Fprintf(w, "server_starter_reload_duration_seconds %f\n", m.reloadDurationSecs)
+
+	fmt.Fprintf(w, "# HELP server_starter_worker_exit_status Count of worker exits, by exit status.\n")
+	fmt.Fprintf(w, "# TYPE server_starter_worker_exit_status counter\n")
+	for status, count := range m.exitStatusCounts {
+		fmt.Fprintf(w, "server_starter_worker_exit_status{status=\"%d\"} %d\n", status, count)
+	}
+}
+
+// serveMetrics listens on addr and serves /metrics in the background
+// until the returned listener is closed.
+func serveMetrics(addr string, s *Starter) (net.Listener, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		s.metrics.ServeHTTP(w, r, int(s.currentGeneration.Load()))
+	})
+
+	go http.Serve(l, mux)
+
+	return l, nil
+}
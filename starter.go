@@ -1,13 +1,17 @@
 package starter
 
 import (
+	"context"
 	"fmt"
+	"math/rand"
 	"net"
+	"net/http"
 	"os"
 	"os/exec"
 	"os/signal"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"syscall"
 	"time"
 )
@@ -68,12 +72,127 @@ type Config interface {
 	SignalOnHUP() os.Signal  // Signal to send when HUP is received
 	SignalOnTERM() os.Signal // Signal to send when TERM is received
 	StatusFile() string
+
+	// GracefulShutdownTimeout is how long to wait for a worker to exit
+	// on its own after being signaled before it is escalated to
+	// SIGKILL. Zero (the default) waits forever, matching the old
+	// behavior. Can also be set via the GRACEFUL_SHUTDOWN_TIMEOUT
+	// environment variable (in seconds).
+	GracefulShutdownTimeout() time.Duration
+
+	// ControlSocket is the path of a UNIX socket the supervisor
+	// listens on for control API requests (see control.go). Empty
+	// disables the control API.
+	ControlSocket() string
+
+	// CrashLoopBackoffBase is the initial delay between worker start
+	// attempts when the worker keeps failing to come up; it doubles
+	// on every consecutive failure up to CrashLoopBackoffCap. Zero
+	// defaults to 500ms.
+	CrashLoopBackoffBase() time.Duration
+	// CrashLoopBackoffCap caps the exponential backoff delay. Zero
+	// defaults to 30s.
+	CrashLoopBackoffCap() time.Duration
+	// CrashLoopBackoffJitter adds up to 20% random jitter to each
+	// backoff delay, to avoid a thundering herd if several workers
+	// are crash-looping at once.
+	CrashLoopBackoffJitter() bool
+	// MaxConsecutiveFailures is how many times in a row a worker may
+	// fail to start (or die within Interval()) before StartWorker
+	// gives up and reports an error. Zero defaults to 10.
+	MaxConsecutiveFailures() int
+	// OnCrashLoop decides what Run() does once the crash-loop failure
+	// budget above is exhausted.
+	OnCrashLoop() CrashLoopPolicy
+	// CrashLoopCallback is invoked with the crash-loop error when
+	// OnCrashLoop is OnCrashLoopCallback.
+	CrashLoopCallback() func(error)
+
+	// HealthCheck gates a rolling restart: once a new worker is
+	// spawned, Run() waits for it to pass this probe before killing
+	// the old workers. The zero value (Kind HealthCheckNone) skips
+	// the gate and kills old workers unconditionally, matching the
+	// old behavior.
+	HealthCheck() HealthCheck
+
+	// DisableStderrLogging turns off the line-per-event stderr
+	// logging Run() and StartWorker() have always done, for callers
+	// that consume Starter.Events() instead.
+	DisableStderrLogging() bool
+	// MetricsAddr, if non-empty, is the address Run() serves a
+	// Prometheus-style /metrics endpoint on (e.g. "127.0.0.1:9090").
+	// Empty disables it.
+	MetricsAddr() string
+}
+
+// HealthCheckKind selects which kind of readiness probe HealthCheck
+// runs against a newly spawned worker.
+type HealthCheckKind int
+
+const (
+	// HealthCheckNone disables the health-check gate.
+	HealthCheckNone HealthCheckKind = iota
+	// HealthCheckTCP dials Addr (or the first bound port, if Addr is
+	// empty) and considers the worker ready as soon as the connect
+	// succeeds.
+	HealthCheckTCP
+	// HealthCheckHTTP issues a GET to URL and considers the worker
+	// ready on any 2xx response.
+	HealthCheckHTTP
+	// HealthCheckExec runs Command with Args and considers the
+	// worker ready if it exits zero.
+	HealthCheckExec
+)
+
+// HealthCheck describes the readiness probe Run() uses to gate a
+// rolling restart: it retries the probe, spaced Timeout apart, until
+// it succeeds or Budget elapses.
+type HealthCheck struct {
+	Kind    HealthCheckKind
+	Addr    string   // HealthCheckTCP
+	URL     string   // HealthCheckHTTP
+	Command string   // HealthCheckExec
+	Args    []string // HealthCheckExec
+
+	Timeout time.Duration // per-probe timeout; defaults to 1s
+	Budget  time.Duration // total time to retry before giving up; defaults to Config.Interval()
 }
 
+// CrashLoopPolicy controls what happens once a worker has failed to
+// start MaxConsecutiveFailures times in a row.
+type CrashLoopPolicy int
+
+const (
+	// OnCrashLoopExit makes Run() return the crash-loop error,
+	// letting the caller exit non-zero (CI/systemd friendly).
+	OnCrashLoopExit CrashLoopPolicy = iota
+	// OnCrashLoopContinue logs the error and keeps retrying forever.
+	OnCrashLoopContinue
+	// OnCrashLoopCallback invokes CrashLoopCallback and then keeps
+	// retrying forever, like OnCrashLoopContinue.
+	OnCrashLoopCallback
+)
+
 type Starter struct {
-	interval     time.Duration
-	signalOnHUP  os.Signal
-	signalOnTERM os.Signal
+	interval                time.Duration
+	signalOnHUP             os.Signal
+	signalOnTERM            os.Signal
+	gracefulShutdownTimeout time.Duration
+	controlSocket           string
+	controlListener         net.Listener
+	crashLoopBackoffBase    time.Duration
+	crashLoopBackoffCap     time.Duration
+	crashLoopBackoffJitter  bool
+	maxConsecutiveFailures  int
+	onCrashLoop             CrashLoopPolicy
+	crashLoopCallback       func(error)
+	healthCheck             HealthCheck
+	events                  chan Event
+	metrics                 *starterMetrics
+	disableStderrLogging    bool
+	metricsAddr             string
+	metricsListener         net.Listener
+	reloadStartedAt         time.Time
 	// you can't set this in go:	backlog
 	statusFile string
 	pidFile    string
@@ -81,9 +200,17 @@ type Starter struct {
 	ports      []string
 	paths      []string
 	listeners  []net.Listener
-	generation int
-	command    string
-	args       []string
+	// generation counts every worker start attempt and only ever
+	// moves forward. It is accessed atomically, like currentGeneration
+	// below, which is the value the /metrics HTTP handler reads.
+	generation atomic.Int64
+	// currentGeneration mirrors Run()'s local currentGen (the
+	// generation of the worker actually serving traffic, which can
+	// lag behind generation after a health-check rollback) so that
+	// serveMetrics, running on its own goroutine, can report it too.
+	currentGeneration atomic.Int64
+	command           string
+	args              []string
 }
 
 // NewStarter creates a new Starter object. Config parameter may NOT be
@@ -106,18 +233,44 @@ func NewStarter(c Config) (*Starter, error) {
 		return nil, fmt.Errorf("argument Command must be specified")
 	}
 
+	crashLoopBackoffBase := c.CrashLoopBackoffBase()
+	if crashLoopBackoffBase <= 0 {
+		crashLoopBackoffBase = 500 * time.Millisecond
+	}
+	crashLoopBackoffCap := c.CrashLoopBackoffCap()
+	if crashLoopBackoffCap <= 0 {
+		crashLoopBackoffCap = 30 * time.Second
+	}
+	maxConsecutiveFailures := c.MaxConsecutiveFailures()
+	if maxConsecutiveFailures <= 0 {
+		maxConsecutiveFailures = 10
+	}
+
 	s := &Starter{
-		args:         c.Args(),
-		command:      c.Command(),
-		dir:          c.Dir(),
-		interval:     c.Interval(),
-		listeners:    make([]net.Listener, len(c.Ports())+len(c.Paths())),
-		pidFile:      c.PidFile(),
-		ports:        c.Ports(),
-		paths:        c.Paths(),
-		signalOnHUP:  signalOnHUP,
-		signalOnTERM: signalOnTERM,
-		statusFile:   c.StatusFile(),
+		args:                    c.Args(),
+		command:                 c.Command(),
+		dir:                     c.Dir(),
+		interval:                c.Interval(),
+		listeners:               make([]net.Listener, len(c.Ports())+len(c.Paths())),
+		pidFile:                 c.PidFile(),
+		ports:                   c.Ports(),
+		paths:                   c.Paths(),
+		signalOnHUP:             signalOnHUP,
+		signalOnTERM:            signalOnTERM,
+		gracefulShutdownTimeout: getGracefulShutdownTimeout(c.GracefulShutdownTimeout()),
+		controlSocket:           c.ControlSocket(),
+		crashLoopBackoffBase:    crashLoopBackoffBase,
+		crashLoopBackoffCap:     crashLoopBackoffCap,
+		crashLoopBackoffJitter:  c.CrashLoopBackoffJitter(),
+		maxConsecutiveFailures:  maxConsecutiveFailures,
+		onCrashLoop:             c.OnCrashLoop(),
+		crashLoopCallback:       c.CrashLoopCallback(),
+		healthCheck:             c.HealthCheck(),
+		events:                  make(chan Event, 64),
+		metrics:                 newStarterMetrics(),
+		disableStderrLogging:    c.DisableStderrLogging(),
+		metricsAddr:             c.MetricsAddr(),
+		statusFile:              c.StatusFile(),
 	}
 	return s, nil
 }
@@ -132,7 +285,7 @@ func (s *Starter) Close() {
 	}
 }
 
-func (s Starter) Stop() {
+func (s *Starter) Stop() {
 	p, _ := os.FindProcess(os.Getpid())
 	p.Signal(syscall.SIGTERM)
 }
@@ -225,8 +378,38 @@ func (s *Starter) Run() error {
 		s.listeners[i] = l
 	}
 
-	s.generation = 0
-	os.Setenv("SERVER_STARTER_GENERATION", fmt.Sprintf("%d", s.generation))
+	for i, path := range s.paths {
+		// Remove a stale socket file left over from a previous run,
+		// otherwise net.Listen("unix", ...) fails with "address already in use"
+		os.Remove(path)
+
+		l, err := net.Listen("unix", path)
+		if err != nil {
+			return err
+		}
+		s.listeners[len(s.ports)+i] = l
+	}
+
+	var controlCh chan controlRequest
+	if s.controlSocket != "" {
+		controlCh = make(chan controlRequest)
+		l, err := serveControl(s.controlSocket, controlCh)
+		if err != nil {
+			return err
+		}
+		s.controlListener = l
+	}
+
+	if s.metricsAddr != "" {
+		l, err := serveMetrics(s.metricsAddr, s)
+		if err != nil {
+			return err
+		}
+		s.metricsListener = l
+	}
+
+	s.generation.Store(0)
+	os.Setenv("SERVER_STARTER_GENERATION", fmt.Sprintf("%d", s.generation.Load()))
 
 	// XXX Not portable
 	sigCh := make(chan os.Signal, 1)
@@ -240,45 +423,56 @@ func (s *Starter) Run() error {
 	// Okay, ready to launch the program now...
 	setEnv()
 	workerCh := make(chan processState)
-	p := s.StartWorker(sigCh, workerCh)
-	oldWorkers := make(map[int]int)
 	var sigReceived os.Signal
 	var sigToSend os.Signal
+	p, sig, err := s.awaitWorker(sigCh, controlCh, workerCh)
+	if err != nil {
+		return err
+	}
+	if sig != nil {
+		sigReceived = sig
+		if sig == syscall.SIGTERM {
+			sigToSend = s.signalOnTERM
+		} else {
+			sigToSend = syscall.SIGTERM
+		}
+		return nil
+	}
+	// currentGen is the generation of p, the current worker. It is
+	// tracked alongside p (rather than read from s.generation, which
+	// only ever moves forward) so that a rolled-back rolling restart
+	// reports the generation of the worker actually serving traffic,
+	// not the failed replacement's.
+	currentGen := int(s.generation.Load())
+	s.currentGeneration.Store(int64(currentGen))
+	oldWorkers := make(map[int]int)
 
 	defer func() {
 		if p != nil {
-			oldWorkers[p.Pid] = s.generation
+			oldWorkers[p.Pid] = currentGen
 		}
 
-		fmt.Fprintf(os.Stderr, "received %s, sending %s to all workers:",
-			signame(sigReceived),
-			signame(sigToSend),
-		)
-		size := len(oldWorkers)
-		i := 0
-		for pid := range oldWorkers {
-			i++
-			fmt.Fprintf(os.Stderr, "%d", pid)
-			if i < size {
-				fmt.Fprintf(os.Stderr, ",")
-			}
-		}
-		fmt.Fprintf(os.Stderr, "\n")
-
-		for pid := range oldWorkers {
-			worker, err := os.FindProcess(pid)
-			if err != nil {
-				continue
+		if !s.disableStderrLogging {
+			fmt.Fprintf(os.Stderr, "received %s, sending %s to all workers:",
+				signame(sigReceived),
+				signame(sigToSend),
+			)
+			size := len(oldWorkers)
+			i := 0
+			for pid := range oldWorkers {
+				i++
+				fmt.Fprintf(os.Stderr, "%d", pid)
+				if i < size {
+					fmt.Fprintf(os.Stderr, ",")
+				}
 			}
-			worker.Signal(sigToSend)
+			fmt.Fprintf(os.Stderr, "\n")
 		}
 
-		for len(oldWorkers) > 0 {
-			st := <-workerCh
-			fmt.Fprintf(os.Stderr, "worker %d died, status:%d\n", st.Pid(), grabExitStatus(st))
-			delete(oldWorkers, st.Pid())
+		s.gracefulKill(oldWorkers, sigToSend, workerCh, nil, nil)
+		if !s.disableStderrLogging {
+			fmt.Fprintf(os.Stderr, "exiting\n")
 		}
-		fmt.Fprintf(os.Stderr, "exiting\n")
 	}()
 
 	//	var lastRestartTime time.Time
@@ -297,20 +491,36 @@ func (s *Starter) Run() error {
 				// oops, the worker exited? check for its pid
 				if p.Pid == st.Pid() { // current worker
 					exitSt := grabExitStatus(st)
-					fmt.Fprintf(os.Stderr, "worker %d died unexpectedly with status %d, restarting\n", p.Pid, exitSt)
-					p = s.StartWorker(sigCh, workerCh)
+					s.emit(Event{Kind: WorkerDied, Pid: p.Pid, ExitStatus: int(exitSt), Generation: currentGen})
+					var sig os.Signal
+					p, sig, err = s.awaitWorker(sigCh, controlCh, workerCh)
+					if err != nil {
+						return err
+					}
+					if sig != nil {
+						sigReceived = sig
+						if sig == syscall.SIGTERM {
+							sigToSend = s.signalOnTERM
+						} else {
+							sigToSend = syscall.SIGTERM
+						}
+						return nil
+					}
+					currentGen = int(s.generation.Load())
+					s.currentGeneration.Store(int64(currentGen))
 					// lastRestartTime = time.Now()
 				} else {
 					exitSt := grabExitStatus(st)
-					fmt.Fprintf(os.Stderr, "old worker %d died, status:%d\n", st.Pid(), exitSt)
+					s.emit(Event{Kind: WorkerDied, Pid: st.Pid(), ExitStatus: int(exitSt), Generation: oldWorkers[st.Pid()]})
 					delete(oldWorkers, st.Pid())
 				}
 			case sigReceived = <-sigCh:
+				s.emit(Event{Kind: SignalReceived, Signal: signame(sigReceived)})
+
 				// Temporary fix
 				switch sigReceived {
 				case syscall.SIGHUP:
 					// When we receive a HUP signal, we need to spawn a new worker
-					fmt.Fprintf(os.Stderr, "received HUP (num_old_workers=TODO)\n")
 					restart = 1
 					sigToSend = s.signalOnHUP
 				case syscall.SIGTERM:
@@ -320,50 +530,386 @@ func (s *Starter) Run() error {
 					sigToSend = syscall.SIGTERM
 					return nil
 				}
+			case req := <-controlCh:
+				switch req.op {
+				case controlStatus:
+					req.reply <- controlReply{status: s.buildStatus(p, currentGen, oldWorkers)}
+				case controlReload, controlRestart:
+					previousPid := p.Pid
+					previousGen := currentGen
+					s.reloadStartedAt = time.Now()
+					s.emit(Event{Kind: ReloadBegin, Pid: previousPid, Generation: currentGen})
+					oldWorkers[p.Pid] = currentGen
+					newP, sig, err := s.awaitWorker(sigCh, controlCh, workerCh)
+					if err != nil {
+						req.reply <- controlReply{err: err}
+						return err
+					}
+					if sig != nil {
+						req.reply <- controlReply{err: fmt.Errorf("server-starter: reload aborted by %s", signame(sig))}
+						sigReceived = sig
+						if sig == syscall.SIGTERM {
+							sigToSend = s.signalOnTERM
+						} else {
+							sigToSend = syscall.SIGTERM
+						}
+						return nil
+					}
+					newGen := int(s.generation.Load())
+					req.reply <- controlReply{}
+					var gateSig os.Signal
+					p, currentGen, gateSig = s.gateNewWorker(newP, newGen, previousPid, previousGen, oldWorkers, workerCh, sigCh, controlCh)
+					s.currentGeneration.Store(int64(currentGen))
+					s.emit(Event{Kind: ReloadComplete, Pid: p.Pid, Generation: currentGen, Promoted: p.Pid == newP.Pid, FailedPid: newP.Pid})
+					if gateSig != nil {
+						sigReceived = gateSig
+						if gateSig == syscall.SIGTERM {
+							sigToSend = s.signalOnTERM
+						} else {
+							sigToSend = syscall.SIGTERM
+						}
+						return nil
+					}
+				case controlSignal:
+					if worker, err := os.FindProcess(p.Pid); err == nil {
+						worker.Signal(req.signal)
+					}
+					req.reply <- controlReply{}
+				case controlShutdown:
+					if req.timeout > 0 {
+						s.gracefulShutdownTimeout = req.timeout
+					}
+					sigReceived = syscall.SIGTERM
+					sigToSend = s.signalOnTERM
+					req.reply <- controlReply{}
+					return nil
+				}
 			}
 
 			if restart > 1 || restart > 0 && len(oldWorkers) == 0 {
-				fmt.Fprintf(os.Stderr, "spawning a new worker (num_old_workers=TODO)\n")
-				oldWorkers[p.Pid] = s.generation
-				p = s.StartWorker(sigCh, workerCh)
-				fmt.Fprintf(os.Stderr, "new worker is now running, sending %s to old workers:", signame(sigToSend))
-				size := len(oldWorkers)
-				if size == 0 {
-					fmt.Fprintf(os.Stderr, "none\n")
-				} else {
-					i := 0
-					for pid := range oldWorkers {
-						i++
-						fmt.Fprintf(os.Stderr, "%d", pid)
-						if i < size {
-							fmt.Fprintf(os.Stderr, ",")
-						}
+				previousPid := p.Pid
+				previousGen := currentGen
+				s.reloadStartedAt = time.Now()
+				s.emit(Event{Kind: ReloadBegin, Pid: previousPid, Generation: currentGen})
+				oldWorkers[p.Pid] = currentGen
+				newP, sig, err := s.awaitWorker(sigCh, controlCh, workerCh)
+				if err != nil {
+					return err
+				}
+				if sig != nil {
+					sigReceived = sig
+					if sig == syscall.SIGTERM {
+						sigToSend = s.signalOnTERM
+					} else {
+						sigToSend = syscall.SIGTERM
 					}
-					fmt.Fprintf(os.Stderr, "\n")
-
-					killOldDelay := getKillOldDelay()
-					fmt.Fprintf(os.Stderr, "sleep %d secs\n", int(killOldDelay/time.Second))
-					if killOldDelay > 0 {
-						time.Sleep(killOldDelay)
+					return nil
+				}
+				newGen := int(s.generation.Load())
+				p, currentGen, sig = s.gateNewWorker(newP, newGen, previousPid, previousGen, oldWorkers, workerCh, sigCh, controlCh)
+				s.currentGeneration.Store(int64(currentGen))
+				s.emit(Event{Kind: ReloadComplete, Pid: p.Pid, Generation: currentGen, Promoted: p.Pid == newP.Pid, FailedPid: newP.Pid})
+				if sig != nil {
+					sigReceived = sig
+					if sig == syscall.SIGTERM {
+						sigToSend = s.signalOnTERM
+					} else {
+						sigToSend = syscall.SIGTERM
 					}
+					return nil
+				}
+			}
+		}
+	}
 
-					fmt.Fprintf(os.Stderr, "killing old workers\n")
+	return nil
+}
 
-					for pid := range oldWorkers {
-						worker, err := os.FindProcess(pid)
-						if err != nil {
-							continue
-						}
-						worker.Signal(s.signalOnHUP)
-					}
+// getGracefulShutdownTimeout resolves the effective graceful shutdown
+// timeout: an explicitly configured value wins, otherwise it falls
+// back to the GRACEFUL_SHUTDOWN_TIMEOUT environment variable
+// (seconds), otherwise zero (wait forever).
+func getGracefulShutdownTimeout(configured time.Duration) time.Duration {
+	if configured > 0 {
+		return configured
+	}
+
+	secs, _ := strconv.ParseInt(os.Getenv("GRACEFUL_SHUTDOWN_TIMEOUT"), 10, 64)
+	return time.Duration(secs) * time.Second
+}
+
+// gracefulKill signals every pid in workers with sig, then waits for
+// them to exit by draining workerCh. If s.gracefulShutdownTimeout is
+// set and elapses before all of them have exited, the survivors are
+// escalated to SIGKILL and gracefulKill returns without waiting for
+// them any further. Deaths reported for pids not in workers are
+// forwarded back onto workerCh so the caller's own loop can still see
+// them.
+//
+// sigCh and controlCh let a caller that is still inside Run()'s main
+// loop (a live rolling restart, as opposed to final shutdown) keep
+// observing signals and control requests while the drain is in
+// progress; gracefulKill returns the interrupting signal so the
+// caller can abort the same way it would have off sigCh directly. The
+// final-shutdown caller, which has nothing left to forward to, passes
+// nil for both and the corresponding select cases simply never fire.
+func (s *Starter) gracefulKill(workers map[int]int, sig os.Signal, workerCh chan processState, sigCh chan os.Signal, controlCh chan controlRequest) os.Signal {
+	for pid := range workers {
+		worker, err := os.FindProcess(pid)
+		if err != nil {
+			continue
+		}
+		worker.Signal(sig)
+	}
+
+	var deadline <-chan time.Time
+	if s.gracefulShutdownTimeout > 0 {
+		deadline = time.After(s.gracefulShutdownTimeout)
+	}
+
+	for len(workers) > 0 {
+		select {
+		case st := <-workerCh:
+			if _, ok := workers[st.Pid()]; !ok {
+				go func() { workerCh <- st }()
+				continue
+			}
+			s.emit(Event{Kind: OldWorkerKilled, Pid: st.Pid(), ExitStatus: int(grabExitStatus(st)), Generation: workers[st.Pid()]})
+			delete(workers, st.Pid())
+		case <-deadline:
+			if !s.disableStderrLogging {
+				fmt.Fprintf(os.Stderr, "graceful shutdown timeout (%s) exceeded, sending SIGKILL to %d remaining worker(s)\n", s.gracefulShutdownTimeout, len(workers))
+			}
+			for pid := range workers {
+				if worker, err := os.FindProcess(pid); err == nil {
+					worker.Signal(syscall.SIGKILL)
 				}
 			}
+			return nil
+		case sig := <-sigCh:
+			return sig
+		case req := <-controlCh:
+			switch req.op {
+			case controlShutdown:
+				req.reply <- controlReply{}
+				return syscall.SIGTERM
+			case controlStatus:
+				req.reply <- controlReply{}
+			default:
+				req.reply <- controlReply{err: fmt.Errorf("server-starter: a rolling restart is already in progress, try again once it completes")}
+			}
 		}
 	}
-
 	return nil
 }
 
+// buildStatus snapshots the current and old workers for the Status
+// control RPC. currentGen is the generation of p, tracked by the
+// caller rather than read from s.generation (see gateNewWorker).
+func (s *Starter) buildStatus(p *os.Process, currentGen int, oldWorkers map[int]int) ControlStatus {
+	status := ControlStatus{Generation: currentGen}
+	if p != nil {
+		status.Workers = append(status.Workers, ControlWorker{Pid: p.Pid, Generation: currentGen})
+	}
+	for pid, generation := range oldWorkers {
+		status.Workers = append(status.Workers, ControlWorker{Pid: pid, Generation: generation, Old: true})
+	}
+	return status
+}
+
+// gateNewWorker probes newP with s.healthCheck before letting a
+// rolling restart proceed. If the probe passes (or no HealthCheck is
+// configured), the old workers are signaled and reaped as usual and
+// newP/newGen are returned as the current worker. If the probe never
+// succeeds within its budget, newP is killed, previousPid/previousGen
+// (which the caller already demoted into oldWorkers) are promoted
+// back to being the current worker, and those are returned instead.
+// s.generation only ever moves forward, so the generation of the
+// process actually left running has to be tracked here rather than
+// read back off s.generation once a rollback has happened.
+//
+// If a signal or control API Shutdown request interrupts the probe,
+// gateNewWorker rolls back to previousPid/previousGen (the new worker
+// never got to prove itself); if one interrupts the old worker drain
+// instead, newP/newGen stay the current worker. Either way the
+// interrupting signal is returned so the caller can abort exactly as
+// it would have off sigCh directly.
+func (s *Starter) gateNewWorker(newP *os.Process, newGen int, previousPid int, previousGen int, oldWorkers map[int]int, workerCh chan processState, sigCh chan os.Signal, controlCh chan controlRequest) (*os.Process, int, os.Signal) {
+	healthy, sig := s.probeHealthy(s.healthCheck, sigCh, controlCh)
+	if healthy {
+		if sig := s.killOldWorkers(oldWorkers, workerCh, sigCh, controlCh); sig != nil {
+			return newP, newGen, sig
+		}
+		return newP, newGen, nil
+	}
+
+	if worker, err := os.FindProcess(newP.Pid); err == nil {
+		worker.Signal(syscall.SIGKILL)
+	}
+
+	delete(oldWorkers, previousPid)
+	worker, _ := os.FindProcess(previousPid)
+	return worker, previousGen, sig
+}
+
+// probeHealthy retries hc until it succeeds or hc.Budget (default
+// s.interval) elapses. A zero-valued HealthCheck (Kind
+// HealthCheckNone) always succeeds immediately.
+//
+// The wait between attempts is interruptible the same way
+// StartWorker's crash-loop backoff wait is: a signal or a control API
+// Shutdown request aborts the probe immediately instead of leaving
+// Run() unreachable for the whole health-check budget. Other control
+// requests are answered without aborting the probe.
+func (s *Starter) probeHealthy(hc HealthCheck, sigCh chan os.Signal, controlCh chan controlRequest) (bool, os.Signal) {
+	if hc.Kind == HealthCheckNone {
+		return true, nil
+	}
+
+	timeout := hc.Timeout
+	if timeout <= 0 {
+		timeout = time.Second
+	}
+	budget := hc.Budget
+	if budget <= 0 {
+		budget = s.interval
+	}
+
+	deadline := time.Now().Add(budget)
+	for {
+		if s.probeOnce(hc, timeout) {
+			return true, nil
+		}
+		if time.Now().After(deadline) {
+			return false, nil
+		}
+
+		timer := time.NewTimer(timeout)
+	waitLoop:
+		for {
+			select {
+			case <-timer.C:
+				break waitLoop
+			case sig := <-sigCh:
+				return false, sig
+			case req := <-controlCh:
+				switch req.op {
+				case controlShutdown:
+					req.reply <- controlReply{}
+					timer.Stop()
+					return false, syscall.SIGTERM
+				case controlStatus:
+					req.reply <- controlReply{}
+				default:
+					req.reply <- controlReply{err: fmt.Errorf("server-starter: a rolling restart is already in progress, try again once it completes")}
+				}
+			}
+		}
+	}
+}
+
+// probeOnce runs a single attempt of hc's configured probe.
+func (s *Starter) probeOnce(hc HealthCheck, timeout time.Duration) bool {
+	switch hc.Kind {
+	case HealthCheckTCP:
+		addr := hc.Addr
+		if addr == "" && len(s.ports) > 0 {
+			addr = s.ports[0]
+			if port, err := strconv.ParseInt(addr, 10, 64); err == nil { // Looks like port only
+				addr = fmt.Sprintf(":%d", port)
+			}
+		}
+		conn, err := net.DialTimeout("tcp", addr, timeout)
+		if err != nil {
+			return false
+		}
+		conn.Close()
+		return true
+	case HealthCheckHTTP:
+		client := &http.Client{Timeout: timeout}
+		resp, err := client.Get(hc.URL)
+		if err != nil {
+			return false
+		}
+		resp.Body.Close()
+		return resp.StatusCode >= 200 && resp.StatusCode < 300
+	case HealthCheckExec:
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		return exec.CommandContext(ctx, hc.Command, hc.Args...).Run() == nil
+	default:
+		return true
+	}
+}
+
+// killOldWorkers waits out KILL_OLD_DELAY and then signals every
+// worker in oldWorkers with signalOnHUP, escalating to SIGKILL via
+// gracefulKill for any that don't exit in time. It is shared by the
+// signal-driven HUP restart path and the control API's Reload/Restart
+// RPCs.
+//
+// The KILL_OLD_DELAY wait and the drain itself are interruptible the
+// same way StartWorker's crash-loop backoff wait is: killOldWorkers
+// returns the interrupting signal, if any, so the caller can abort
+// exactly as it would have off sigCh directly.
+func (s *Starter) killOldWorkers(oldWorkers map[int]int, workerCh chan processState, sigCh chan os.Signal, controlCh chan controlRequest) os.Signal {
+	if !s.disableStderrLogging {
+		fmt.Fprintf(os.Stderr, "sending %s to old workers:", signame(s.signalOnHUP))
+	}
+	size := len(oldWorkers)
+	if size == 0 {
+		if !s.disableStderrLogging {
+			fmt.Fprintf(os.Stderr, "none\n")
+		}
+		return nil
+	}
+
+	if !s.disableStderrLogging {
+		i := 0
+		for pid := range oldWorkers {
+			i++
+			fmt.Fprintf(os.Stderr, "%d", pid)
+			if i < size {
+				fmt.Fprintf(os.Stderr, ",")
+			}
+		}
+		fmt.Fprintf(os.Stderr, "\n")
+	}
+
+	killOldDelay := getKillOldDelay()
+	if !s.disableStderrLogging {
+		fmt.Fprintf(os.Stderr, "sleep %d secs\n", int(killOldDelay/time.Second))
+	}
+	if killOldDelay > 0 {
+		timer := time.NewTimer(killOldDelay)
+	waitLoop:
+		for {
+			select {
+			case <-timer.C:
+				break waitLoop
+			case sig := <-sigCh:
+				return sig
+			case req := <-controlCh:
+				switch req.op {
+				case controlShutdown:
+					req.reply <- controlReply{}
+					timer.Stop()
+					return syscall.SIGTERM
+				case controlStatus:
+					req.reply <- controlReply{}
+				default:
+					req.reply <- controlReply{err: fmt.Errorf("server-starter: a rolling restart is already in progress, try again once it completes")}
+				}
+			}
+		}
+	}
+
+	if !s.disableStderrLogging {
+		fmt.Fprintf(os.Stderr, "killing old workers\n")
+	}
+	return s.gracefulKill(oldWorkers, s.signalOnHUP, workerCh, sigCh, controlCh)
+}
+
 func getKillOldDelay() time.Duration {
 	// Ignore errors.
 	delay, _ := strconv.ParseInt(os.Getenv("KILL_OLD_DELAY"), 10, 0)
@@ -386,9 +932,107 @@ const (
 	ErrFailedToStart
 )
 
-// StartWorker starts the actual command.
-func (s *Starter) StartWorker(sigCh chan os.Signal, ch chan processState) *os.Process {
-	// Don't give up until we're running.
+// startInterrupted is returned by StartWorker instead of a crash-loop
+// error when a signal, or a control API Shutdown request, arrives
+// while a start attempt's backoff delay is being waited out. It lets Run()
+// react right away instead of leaving the supervisor unreachable for
+// up to CrashLoopBackoffCap while a worker keeps failing to start.
+type startInterrupted struct {
+	sig os.Signal
+}
+
+func (e *startInterrupted) Error() string {
+	return fmt.Sprintf("server-starter: start attempt interrupted by %s", signame(e.sig))
+}
+
+// startWorker wraps StartWorker, applying s.onCrashLoop once the
+// crash-loop failure budget configured on StartWorker is exhausted.
+// OnCrashLoopExit propagates the error to the caller (so Run() can
+// return it and let the process exit non-zero); OnCrashLoopContinue
+// and OnCrashLoopCallback log/notify and keep retrying indefinitely.
+// A *startInterrupted error is passed straight through regardless of
+// onCrashLoop, so Run() always gets a chance to act on the signal or
+// control request that interrupted the backoff wait.
+func (s *Starter) startWorker(sigCh chan os.Signal, controlCh chan controlRequest, workerCh chan processState) (*os.Process, error) {
+	for {
+		p, err := s.StartWorker(sigCh, controlCh, workerCh)
+		if err == nil {
+			return p, nil
+		}
+		if _, ok := err.(*startInterrupted); ok {
+			return nil, err
+		}
+
+		switch s.onCrashLoop {
+		case OnCrashLoopExit:
+			return nil, err
+		case OnCrashLoopCallback:
+			if s.crashLoopCallback != nil {
+				s.crashLoopCallback(err)
+			}
+			fallthrough
+		default: // OnCrashLoopContinue
+			if !s.disableStderrLogging {
+				fmt.Fprintf(os.Stderr, "%s, retrying\n", err)
+			}
+		}
+	}
+}
+
+// awaitWorker calls startWorker, swallowing any HUP that interrupts a
+// crash-loop backoff wait (there's no current worker yet to
+// roll-restart) and otherwise returning the interrupting signal so
+// the caller can handle it exactly as if it had been received
+// directly off sigCh.
+func (s *Starter) awaitWorker(sigCh chan os.Signal, controlCh chan controlRequest, workerCh chan processState) (*os.Process, os.Signal, error) {
+	for {
+		p, err := s.startWorker(sigCh, controlCh, workerCh)
+		if err == nil {
+			return p, nil, nil
+		}
+		sigErr, ok := err.(*startInterrupted)
+		if !ok {
+			return nil, nil, err
+		}
+		s.emit(Event{Kind: SignalReceived, Signal: signame(sigErr.sig)})
+		if sigErr.sig == syscall.SIGHUP {
+			continue
+		}
+		return nil, sigErr.sig, nil
+	}
+}
+
+// crashLoopBackoff returns the delay to wait before the next start
+// attempt after consecutiveFailures failed starts in a row: base,
+// doubling on every failure, capped at capDelay. If jitter is set, up
+// to 20% random jitter is added on top.
+func crashLoopBackoff(baseDelay, capDelay time.Duration, consecutiveFailures int, jitter bool) time.Duration {
+	delay := baseDelay
+	for i := 1; i < consecutiveFailures; i++ {
+		delay *= 2
+		if delay > capDelay {
+			delay = capDelay
+			break
+		}
+	}
+	if delay > capDelay {
+		delay = capDelay
+	}
+
+	if jitter {
+		delay += time.Duration(rand.Int63n(int64(delay)/5 + 1))
+	}
+
+	return delay
+}
+
+// StartWorker starts the actual command, retrying with exponential
+// backoff while the worker keeps failing to start or dies within
+// Interval(). It gives up and returns an error once the worker has
+// failed s.maxConsecutiveFailures times in a row; a worker that
+// survives the Interval() liveness check resets the count.
+func (s *Starter) StartWorker(sigCh chan os.Signal, controlCh chan controlRequest, ch chan processState) (*os.Process, error) {
+	consecutiveFailures := 0
 	for {
 		pid := -1
 		cmd := exec.Command(s.command, s.args...)
@@ -401,10 +1045,20 @@ func (s *Starter) StartWorker(sigCh chan os.Signal, ch chan processState) *os.Pr
 		// This whole section here basically sets up the env
 		// var and the file descriptors that are inherited by the
 		// external process
-		files := make([]*os.File, len(s.ports))
-		ports := make([]string, len(s.ports))
+		addrs := append(append([]string{}, s.ports...), s.paths...)
+		files := make([]*os.File, len(s.listeners))
+		ports := make([]string, len(s.listeners))
 		for i, l := range s.listeners {
-			f, err := l.(*net.TCPListener).File()
+			var f *os.File
+			var err error
+			switch tl := l.(type) {
+			case *net.TCPListener:
+				f, err = tl.File()
+			case *net.UnixListener:
+				f, err = tl.File()
+			default:
+				panic(fmt.Sprintf("server-starter: unsupported listener type %T", l))
+			}
 			if err != nil {
 				panic(err)
 			}
@@ -412,22 +1066,23 @@ func (s *Starter) StartWorker(sigCh chan os.Signal, ch chan processState) *os.Pr
 
 			// file descriptor numbers in ExtraFiles turn out to be
 			// index + 3, so we can just hard code it
-			ports[i] = fmt.Sprintf("%s=%d", s.ports[i], i+3)
+			ports[i] = fmt.Sprintf("%s=%d", addrs[i], i+3)
 			files[i] = f
 		}
 		cmd.ExtraFiles = files
 
-		s.generation++
+		s.generation.Add(1)
 		os.Setenv("SERVER_STARTER_PORT", strings.Join(ports, ";"))
-		os.Setenv("SERVER_STARTER_GENERATION", fmt.Sprintf("%d", s.generation))
+		os.Setenv("SERVER_STARTER_GENERATION", fmt.Sprintf("%d", s.generation.Load()))
 
 		// Now start!
 		if err := cmd.Start(); err != nil {
-			fmt.Fprintf(os.Stderr, "failed to exec %s: %s\n", cmd.Path, err)
+			if !s.disableStderrLogging {
+				fmt.Fprintf(os.Stderr, "failed to exec %s: %s\n", cmd.Path, err)
+			}
 		} else {
 			// Save pid...
 			pid = cmd.Process.Pid
-			fmt.Fprintf(os.Stderr, "starting new worker %d\n", pid)
 
 			// Wait for interval before checking if the process is alive
 			tch := time.After(s.interval)
@@ -470,8 +1125,9 @@ func (s *Starter) StartWorker(sigCh chan os.Signal, ch chan processState) *os.Pr
 						ch <- &dummyProcessState{pid: pid, status: 0}
 					}
 				}()
+				s.emit(Event{Kind: WorkerSpawned, Pid: pid, Generation: int(s.generation.Load())})
 				// Bail out
-				return p
+				return p, nil
 			}
 
 		}
@@ -482,11 +1138,46 @@ func (s *Starter) StartWorker(sigCh chan os.Signal, ch chan processState) *os.Pr
 			f.Close()
 		}
 
-		fmt.Fprintf(os.Stderr, "new worker %d seems to have failed to start\n", pid)
+		consecutiveFailures++
+		if consecutiveFailures >= s.maxConsecutiveFailures {
+			return nil, fmt.Errorf("server-starter: worker %d failed to start %d times in a row, giving up", pid, consecutiveFailures)
+		}
+
+		delay := crashLoopBackoff(s.crashLoopBackoffBase, s.crashLoopBackoffCap, consecutiveFailures, s.crashLoopBackoffJitter)
+		if !s.disableStderrLogging {
+			fmt.Fprintf(os.Stderr, "new worker %d seems to have failed to start, retrying in %s (failure %d/%d)\n", pid, delay, consecutiveFailures, s.maxConsecutiveFailures)
+		}
+
+		// Wait out the backoff delay, but don't let it swallow a
+		// signal or control request for up to CrashLoopBackoffCap: a
+		// plain SIGTERM must still be able to reach Run() promptly
+		// even while the worker keeps failing to start.
+		timer := time.NewTimer(delay)
+	waitLoop:
+		for {
+			select {
+			case <-timer.C:
+				break waitLoop
+			case sig := <-sigCh:
+				timer.Stop()
+				return nil, &startInterrupted{sig: sig}
+			case req := <-controlCh:
+				switch req.op {
+				case controlShutdown:
+					req.reply <- controlReply{}
+					timer.Stop()
+					return nil, &startInterrupted{sig: syscall.SIGTERM}
+				case controlStatus:
+					req.reply <- controlReply{}
+				default:
+					req.reply <- controlReply{err: fmt.Errorf("server-starter: worker %d is crash-looping, try again once it recovers", pid)}
+				}
+			}
+		}
 	}
 
 	// never reached
-	return nil
+	return nil, nil
 }
 
 func (s *Starter) Teardown() error {
@@ -501,5 +1192,13 @@ func (s *Starter) Teardown() error {
 		l.Close()
 	}
 
+	if s.controlListener != nil {
+		s.controlListener.Close()
+	}
+
+	if s.metricsListener != nil {
+		s.metricsListener.Close()
+	}
+
 	return nil
-}
\ No newline at end of file
+}